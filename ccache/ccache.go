@@ -0,0 +1,564 @@
+// Package ccache reads and writes MIT/Heimdal style Kerberos credential
+// caches (the "FILE:" ccache format used by kinit/klist/kvno), so programs
+// using the parent kerb package can share tickets with the system
+// Kerberos tools instead of running a fresh AS-REQ on every invocation.
+package ccache
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/cention-sany/go.kerb"
+)
+
+// Supported FILE ccache format versions (the second byte of the 2 byte
+// file header, after the 0x05 major version byte).
+const (
+	vers1 = 1
+	vers2 = 2
+	vers3 = 3
+	vers4 = 4
+)
+
+const headerTagDeltaTime = 1
+
+// Principal is a client or server principal as stored in a ccache: a
+// name-type plus the realm and the name's slash-separated components.
+type Principal struct {
+	NameType   int32
+	Realm      string
+	Components []string
+}
+
+// Credential is a single cached ticket: the principals it was issued
+// between, the session key, its validity window and flags, and the raw
+// ticket bytes themselves.
+type Credential struct {
+	Client, Server Principal
+
+	KeyType  int32
+	KeyValue []byte
+
+	AuthTime, StartTime, EndTime, RenewTill time.Time
+	IsSKey                                  bool
+	Flags                                   uint32
+
+	Addresses []Address
+	AuthData  []AuthDataEntry
+
+	Ticket       []byte
+	SecondTicket []byte
+}
+
+// Address is a cached client address (ADDRESS in the krb5 wire format).
+type Address struct {
+	Type uint16
+	Data []byte
+}
+
+// AuthDataEntry is a single opaque authorization-data element, preserved
+// verbatim since this package has no need to interpret it.
+type AuthDataEntry struct {
+	Type uint16
+	Data []byte
+}
+
+// Cache is an in-memory representation of a FILE ccache: a version, a
+// default principal and zero or more credentials.
+type Cache struct {
+	Version          uint8
+	DefaultPrincipal Principal
+	Credentials      []*Credential
+
+	path string
+}
+
+// New returns an empty cache that will be written to path on the first
+// call to Store, for the case where no ccache file exists yet (e.g. a
+// fresh process that hasn't run kinit before). defaultPrincipal becomes
+// the cache's default principal, the one klist shows and kinit renews by
+// default.
+func New(path string, defaultPrincipal Principal) *Cache {
+	return &Cache{
+		Version:          vers4,
+		DefaultPrincipal: defaultPrincipal,
+		path:             path,
+	}
+}
+
+// Load reads and parses the ccache at path.
+func Load(path string) (*Cache, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	c.path = path
+	return c, nil
+}
+
+// LoadFromEnv loads the ccache named by KRB5CCNAME, honoring its
+// "FILE:", "DIR:" and "MEMORY:" prefixes. With no prefix the value is
+// used as a file path. If KRB5CCNAME is unset it returns an error: the
+// usual /tmp/krb5cc_<uid> default is not resolved here, since this
+// package has no portable way to read the current uid; callers should
+// pass an explicit path to Load in that case.
+func LoadFromEnv() (*Cache, error) {
+	name := os.Getenv("KRB5CCNAME")
+	if name == "" {
+		return nil, fmt.Errorf("ccache: KRB5CCNAME not set")
+	}
+
+	switch {
+	case strings.HasPrefix(name, "FILE:"):
+		return Load(strings.TrimPrefix(name, "FILE:"))
+	case strings.HasPrefix(name, "DIR:"):
+		dir := strings.TrimPrefix(name, "DIR:")
+		return loadPrimaryFromDir(dir)
+	case strings.HasPrefix(name, "MEMORY:"):
+		return nil, fmt.Errorf("ccache: MEMORY: caches are process-local and can't be loaded across processes")
+	default:
+		return Load(name)
+	}
+}
+
+// loadPrimaryFromDir reads a DIR: cache collection's "primary" file to
+// find which cache in the directory to load, per the MIT krb5 DIR
+// residual convention.
+func loadPrimaryFromDir(dir string) (*Cache, error) {
+	primary, err := ioutil.ReadFile(filepath.Join(dir, "primary"))
+	if err != nil {
+		return nil, err
+	}
+	name := strings.TrimSpace(string(primary))
+	return Load(filepath.Join(dir, name))
+}
+
+// Ticket converts credential i into a *kerb.Ticket usable with the
+// parent package's request/Ticket APIs.
+func (c *Cache) Ticket(i int) (*kerb.Ticket, error) {
+	cred := c.Credentials[i]
+	return kerb.NewTicket(
+		cred.Client.NameType, cred.Client.Components, cred.Client.Realm,
+		cred.Server.NameType, cred.Server.Components, cred.Server.Realm,
+		cred.Ticket, cred.EndTime, cred.RenewTill, int(cred.Flags),
+		cred.KeyType, cred.KeyValue, 0)
+}
+
+// Store appends t to the cache, then atomically rewrites the backing
+// file (write to a temp file in the same directory, then rename over
+// the original) so a concurrent klist never observes a partially
+// written cache.
+func (c *Cache) Store(t *kerb.Ticket) error {
+	clientType, client, crealm, serviceType, service, srealm,
+		ticketData, till, renewTill, flags, keyType, keyValue, _ := t.Export()
+
+	c.Credentials = append(c.Credentials, &Credential{
+		Client:    Principal{NameType: clientType, Realm: crealm, Components: client},
+		Server:    Principal{NameType: serviceType, Realm: srealm, Components: service},
+		KeyType:   keyType,
+		KeyValue:  keyValue,
+		AuthTime:  time.Now(),
+		StartTime: time.Now(),
+		EndTime:   till,
+		RenewTill: renewTill,
+		Flags:     uint32(flags),
+		Ticket:    ticketData,
+	})
+
+	if c.path == "" {
+		return nil
+	}
+
+	data, err := c.marshal()
+	if err != nil {
+		return err
+	}
+
+	dir := filepath.Dir(c.path)
+	tmp, err := ioutil.TempFile(dir, ".ccache-tmp-")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	return os.Rename(tmpName, c.path)
+}
+
+// --- parsing ---
+
+type reader struct {
+	b *bytes.Reader
+}
+
+func (r *reader) u8() (uint8, error) {
+	var v uint8
+	err := binary.Read(r.b, binary.BigEndian, &v)
+	return v, err
+}
+
+func (r *reader) u16() (uint16, error) {
+	var v uint16
+	err := binary.Read(r.b, binary.BigEndian, &v)
+	return v, err
+}
+
+func (r *reader) u32() (uint32, error) {
+	var v uint32
+	err := binary.Read(r.b, binary.BigEndian, &v)
+	return v, err
+}
+
+func (r *reader) bytesN(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r.b, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// countedString reads a 32bit big-endian length followed by that many
+// bytes of data, the encoding ccache uses for every variable length
+// field (realm names, principal components, keys, tickets, ...).
+func (r *reader) countedString() (string, error) {
+	n, err := r.u32()
+	if err != nil {
+		return "", err
+	}
+	data, err := r.bytesN(int(n))
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+func (r *reader) countedBytes() ([]byte, error) {
+	n, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	return r.bytesN(int(n))
+}
+
+func parse(data []byte) (*Cache, error) {
+	r := &reader{b: bytes.NewReader(data)}
+
+	magic, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	if magic != 5 {
+		return nil, fmt.Errorf("ccache: unsupported file format (expected major version 5, got %d)", magic)
+	}
+
+	version, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	if version < vers1 || version > vers4 {
+		return nil, fmt.Errorf("ccache: unsupported ccache version %d", version)
+	}
+
+	c := &Cache{Version: version}
+
+	if version == vers4 {
+		if err := skipHeader(r); err != nil {
+			return nil, err
+		}
+	}
+
+	c.DefaultPrincipal, err = parsePrincipal(r, version)
+	if err != nil {
+		return nil, err
+	}
+
+	for r.b.Len() > 0 {
+		cred, err := parseCredential(r, version)
+		if err != nil {
+			return nil, err
+		}
+		c.Credentials = append(c.Credentials, cred)
+	}
+
+	return c, nil
+}
+
+// skipHeader reads (and discards) the version 4 tagged header block; we
+// have no use for its contents (the only field krb5 defines,
+// DeltaTime, affects clock-skew handling kinit itself applies, not
+// ticket validity as this package understands it).
+func skipHeader(r *reader) error {
+	length, err := r.u16()
+	if err != nil {
+		return err
+	}
+	end := 0
+	for end < int(length) {
+		if _, err := r.u16(); err != nil { // tag
+			return err
+		}
+		taglen, err := r.u16()
+		if err != nil {
+			return err
+		}
+		if _, err := r.bytesN(int(taglen)); err != nil {
+			return err
+		}
+		end += 4 + int(taglen)
+	}
+	return nil
+}
+
+func parsePrincipal(r *reader, version uint8) (Principal, error) {
+	var nameType int32
+	if version != vers1 {
+		v, err := r.u32()
+		if err != nil {
+			return Principal{}, err
+		}
+		nameType = int32(v)
+	}
+
+	count, err := r.u32()
+	if err != nil {
+		return Principal{}, err
+	}
+	// Version 1 bundles the realm in with the component count.
+	if version == vers1 {
+		count--
+	}
+
+	realm, err := r.countedString()
+	if err != nil {
+		return Principal{}, err
+	}
+
+	components := make([]string, count)
+	for i := range components {
+		components[i], err = r.countedString()
+		if err != nil {
+			return Principal{}, err
+		}
+	}
+
+	return Principal{NameType: nameType, Realm: realm, Components: components}, nil
+}
+
+func parseCredential(r *reader, version uint8) (*Credential, error) {
+	cred := &Credential{}
+
+	var err error
+	if cred.Client, err = parsePrincipal(r, version); err != nil {
+		return nil, err
+	}
+	if cred.Server, err = parsePrincipal(r, version); err != nil {
+		return nil, err
+	}
+
+	if cred.KeyType, cred.KeyValue, err = parseKeyBlock(r, version); err != nil {
+		return nil, err
+	}
+
+	dests := []*time.Time{&cred.AuthTime, &cred.StartTime, &cred.EndTime, &cred.RenewTill}
+	for _, dst := range dests {
+		secs, err := r.u32()
+		if err != nil {
+			return nil, err
+		}
+		*dst = time.Unix(int64(secs), 0)
+	}
+
+	isSKey, err := r.u8()
+	if err != nil {
+		return nil, err
+	}
+	cred.IsSKey = isSKey != 0
+
+	flags, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	cred.Flags = flags
+
+	naddr, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < naddr; i++ {
+		addrType, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.countedBytes()
+		if err != nil {
+			return nil, err
+		}
+		cred.Addresses = append(cred.Addresses, Address{Type: addrType, Data: data})
+	}
+
+	nauth, err := r.u32()
+	if err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < nauth; i++ {
+		adType, err := r.u16()
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.countedBytes()
+		if err != nil {
+			return nil, err
+		}
+		cred.AuthData = append(cred.AuthData, AuthDataEntry{Type: adType, Data: data})
+	}
+
+	if cred.Ticket, err = r.countedBytes(); err != nil {
+		return nil, err
+	}
+	if cred.SecondTicket, err = r.countedBytes(); err != nil {
+		return nil, err
+	}
+
+	return cred, nil
+}
+
+// parseKeyBlock reads a keyblock: an enctype (and, in version 3 caches
+// only, a duplicate enctype field left over from an earlier on-disk
+// layout) followed by the counted key bytes.
+func parseKeyBlock(r *reader, version uint8) (int32, []byte, error) {
+	keyType, err := r.u16()
+	if err != nil {
+		return 0, nil, err
+	}
+	if version == vers3 {
+		if _, err := r.u16(); err != nil {
+			return 0, nil, err
+		}
+	}
+
+	key, err := r.countedBytes()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return int32(keyType), key, nil
+}
+
+// --- marshaling ---
+
+type writer struct {
+	buf bytes.Buffer
+}
+
+func (w *writer) u8(v uint8)   { w.buf.WriteByte(v) }
+func (w *writer) u16(v uint16) { binary.Write(&w.buf, binary.BigEndian, v) }
+func (w *writer) u32(v uint32) { binary.Write(&w.buf, binary.BigEndian, v) }
+
+func (w *writer) countedString(s string) {
+	w.u32(uint32(len(s)))
+	w.buf.WriteString(s)
+}
+
+func (w *writer) countedBytes(b []byte) {
+	w.u32(uint32(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *writer) principal(p Principal, version uint8) {
+	if version != vers1 {
+		w.u32(uint32(p.NameType))
+	}
+
+	count := uint32(len(p.Components))
+	if version == vers1 {
+		count++
+	}
+	w.u32(count)
+
+	w.countedString(p.Realm)
+	for _, c := range p.Components {
+		w.countedString(c)
+	}
+}
+
+func (w *writer) credential(c *Credential, version uint8) {
+	w.principal(c.Client, version)
+	w.principal(c.Server, version)
+
+	w.u16(uint16(c.KeyType))
+	if version == vers3 {
+		w.u16(uint16(c.KeyType))
+	}
+	w.countedBytes(c.KeyValue)
+
+	for _, t := range []time.Time{c.AuthTime, c.StartTime, c.EndTime, c.RenewTill} {
+		w.u32(uint32(t.Unix()))
+	}
+
+	if c.IsSKey {
+		w.u8(1)
+	} else {
+		w.u8(0)
+	}
+
+	w.u32(c.Flags)
+
+	w.u32(uint32(len(c.Addresses)))
+	for _, a := range c.Addresses {
+		w.u16(a.Type)
+		w.countedBytes(a.Data)
+	}
+
+	w.u32(uint32(len(c.AuthData)))
+	for _, a := range c.AuthData {
+		w.u16(a.Type)
+		w.countedBytes(a.Data)
+	}
+
+	w.countedBytes(c.Ticket)
+	w.countedBytes(c.SecondTicket)
+}
+
+func (w *writer) countedBytes16(b []byte) {
+	w.u16(uint16(len(b)))
+	w.buf.Write(b)
+}
+
+// marshal serializes the cache back into the FILE ccache wire format.
+func (c *Cache) marshal() ([]byte, error) {
+	w := &writer{}
+	w.u8(5)
+	w.u8(c.Version)
+
+	if c.Version == vers4 {
+		w.u16(0) // no tagged header fields; we don't track DeltaTime
+	}
+
+	w.principal(c.DefaultPrincipal, c.Version)
+
+	for _, cred := range c.Credentials {
+		w.credential(cred, c.Version)
+	}
+
+	return w.buf.Bytes(), nil
+}
@@ -0,0 +1,42 @@
+package kerb
+
+import "time"
+
+// NewTicket reconstructs a Ticket from its serialized component parts. It
+// exists so external credential cache implementations (see the ccache
+// subpackage) can hand back a Ticket loaded from disk without this
+// package needing to know anything about on-disk cache formats, and
+// without exposing its unexported fields directly.
+func NewTicket(clientType int32, client []string, crealm string, serviceType int32, service []string, srealm string,
+	ticketData []byte, till, renewTill time.Time, flags int, keyType int32, keyValue []byte, kvno int) (*Ticket, error) {
+
+	key, err := loadKey(keyType, keyValue, kvno)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Ticket{
+		client:    principalName{Type: clientType, Name: client},
+		crealm:    crealm,
+		service:   principalName{Type: serviceType, Name: service},
+		srealm:    srealm,
+		ticket:    ticketData,
+		till:      till,
+		renewTill: renewTill,
+		flags:     flags,
+		key:       key,
+		keyType:   keyType,
+		keyValue:  keyValue,
+		kvno:      kvno,
+	}, nil
+}
+
+// Export returns t's component parts in the same form NewTicket accepts,
+// so a credential cache can persist it and later reconstruct an
+// equivalent Ticket without reaching into unexported fields.
+func (t *Ticket) Export() (clientType int32, client []string, crealm string, serviceType int32, service []string, srealm string,
+	ticketData []byte, till, renewTill time.Time, flags int, keyType int32, keyValue []byte, kvno int) {
+
+	return t.client.Type, t.client.Name, t.crealm, t.service.Type, t.service.Name, t.srealm,
+		t.ticket, t.till, t.renewTill, t.flags, t.keyType, t.keyValue, t.kvno
+}
@@ -0,0 +1,287 @@
+package kerb
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/asn1"
+	"fmt"
+)
+
+// PA-FX-FAST, RFC 6113.
+const paFxFast = 136
+
+// FAST armor types (RFC 6113 5.3.1). We only ever build an explicit
+// armor from an AP-REQ using a separately obtained armor ticket (a
+// machine TGT, typically); FAST-negotiated anonymous PKINIT armor isn't
+// implemented.
+const fastArmorApRequest = 1
+
+// KRB-FX-CF2 combines two keys into one using each one's pseudo-random
+// function, so that neither alone can be used to recover the result.
+// Per the pepper strings this package derives the armor key and the
+// strengthened reply key with, see krbFXCF2.
+const (
+	cf2Pepper1 = "kerberos"
+	cf2Pepper2 = "keyexchange"
+)
+
+// Key usage numbers for FAST's own encryption and checksum operations
+// (RFC 6113 7.1), distinct from the usages the wrapped AS/TGS exchange
+// uses for its own fields.
+const (
+	fastReqKey         = 51
+	fastRepKey         = 52
+	fastReqChecksumKey = 50
+	fastRepChecksumKey = 53
+)
+
+// fastCipher is implemented by a cipher that can also act as a FAST
+// armor/reply key: one whose enctype defines the RFC 3961 pseudo-random
+// function and key-generation length KRB-FX-CF2 needs. A cipher that
+// doesn't implement this can't be used for FAST.
+type fastCipher interface {
+	cipher
+	prf(data []byte) ([]byte, error)
+	keyGenLength() int
+}
+
+// prfPlus implements RFC 6113's PRF+, which extends a single PRF
+// invocation's output to an arbitrary number of octets by concatenating
+// PRF(key, pepper || n) for n = 1, 2, ... until enough octets have
+// accumulated.
+func prfPlus(key fastCipher, pepper []byte, n int) ([]byte, error) {
+	var out []byte
+	for i := byte(1); len(out) < n; i++ {
+		chunk, err := key.prf(append(append([]byte(nil), pepper...), i))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+	}
+	return out[:n], nil
+}
+
+// krbFXCF2 combines key1 and key2 into a single armor or reply key of
+// key1's enctype, XORing their PRF+ outputs under the given pepper
+// strings before random-to-key'ing the result (RFC 6113 section 5.1).
+func krbFXCF2(key1, key2 fastCipher, pepper1, pepper2 string) (cipher, error) {
+	n := key1.keyGenLength()
+
+	a, err := prfPlus(key1, []byte(pepper1), n)
+	if err != nil {
+		return nil, err
+	}
+	b, err := prfPlus(key2, []byte(pepper2), n)
+	if err != nil {
+		return nil, err
+	}
+
+	combined := make([]byte, n)
+	for i := range combined {
+		combined[i] = a[i] ^ b[i]
+	}
+
+	etype, _ := key1.etype()
+	return loadKey(etype, combined, 0)
+}
+
+type fastArmor struct {
+	ArmorType  int    `asn1:"explicit,tag:0"`
+	ArmorValue []byte `asn1:"explicit,tag:1"`
+}
+
+// krbFastArmoredReq is PA-FX-FAST's payload on the request side
+// (KrbFastArmoredReq, RFC 6113 5.4.1.1).
+type krbFastArmoredReq struct {
+	Armor       fastArmor     `asn1:"explicit,tag:0"`
+	ReqChecksum []byte        `asn1:"explicit,tag:1"`
+	EncFastReq  encryptedData `asn1:"explicit,tag:2"`
+}
+
+// krbFastReq is the plaintext wrapped inside EncFastReq: the real
+// preauth data and request body, hidden from passive observers.
+type krbFastReq struct {
+	FastOptions asn1.BitString `asn1:"explicit,tag:0"`
+	Padata      []preauth      `asn1:"explicit,tag:1"`
+	ReqBody     asn1.RawValue  `asn1:"explicit,tag:2"`
+}
+
+// krbFastArmoredRep is PA-FX-FAST's payload on the reply side
+// (KrbFastArmoredRep, RFC 6113 5.4.2.1). ReqChecksum lets the client
+// confirm the reply it received actually answers the request it sent,
+// the same protection the request side's own ReqChecksum gives the KDC.
+type krbFastArmoredRep struct {
+	ReqChecksum []byte        `asn1:"explicit,tag:0"`
+	EncFastRep  encryptedData `asn1:"explicit,tag:1"`
+}
+
+// krbFastResponse is the plaintext wrapped inside EncFastRep.
+type krbFastResponse struct {
+	Padata        []preauth     `asn1:"explicit,tag:0"`
+	StrengthenKey encryptionKey `asn1:"explicit,tag:1,optional"`
+	Nonce         uint32        `asn1:"explicit,tag:3"`
+}
+
+// wrapFast builds the PA-FX-FAST preauth element that replaces a
+// request's ordinary padata when r.armor is set: it wraps innerPreauth
+// (what sendRequest would otherwise have sent directly) and the request
+// body in a KrbFastReq, encrypts that under an armor key derived from a
+// fresh subkey and the armor ticket's session key, and returns the
+// outer preauth list plus the armor key so recvReply can unwrap the
+// matching reply.
+func (r *request) wrapFast(bodyData []byte, innerPreauth []preauth) ([]preauth, fastCipher, error) {
+	armorKeyed, ok := r.armor.key.(fastCipher)
+	if !ok {
+		return nil, nil, fmt.Errorf("kerb: armor ticket's enctype does not support FAST")
+	}
+
+	subkey, subkeyValue, err := freshSubkey(armorKeyed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	armorKey, err := krbFXCF2(subkey, armorKeyed, cf2Pepper1, cf2Pepper2)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	auth := authenticator{
+		ProtoVersion: kerberosVersion,
+		ClientRealm:  r.armor.crealm,
+		Client:       r.armor.client,
+		Microseconds: r.seqnum % 1000000,
+		Time:         r.time,
+		Subkey:       subkeyValue,
+	}
+
+	authData, err := asn1.MarshalWithParams(auth, authenticatorParam)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	app := appRequest{
+		ProtoVersion:  kerberosVersion,
+		MsgType:       appRequestType,
+		Flags:         flagsToBitString(0),
+		Ticket:        asn1.RawValue{FullBytes: r.armor.ticket},
+		Authenticator: r.armor.key.encrypt(authData, paTgsRequestKey),
+	}
+
+	appData, err := asn1.MarshalWithParams(app, appRequestParam)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fastReq := krbFastReq{
+		Padata:  innerPreauth,
+		ReqBody: asn1.RawValue{FullBytes: bodyData},
+	}
+	fastReqData, err := asn1.Marshal(fastReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	armored := krbFastArmoredReq{
+		Armor:       fastArmor{ArmorType: fastArmorApRequest, ArmorValue: appData},
+		ReqChecksum: armorKey.checksum(bodyData, fastReqChecksumKey),
+		EncFastReq:  armorKey.encrypt(fastReqData, fastReqKey),
+	}
+
+	armoredData, err := asn1.Marshal(armored)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	armorFast, ok := armorKey.(fastCipher)
+	if !ok {
+		return nil, nil, fmt.Errorf("kerb: derived armor key's enctype does not support FAST")
+	}
+
+	return []preauth{{paFxFast, armoredData}}, armorFast, nil
+}
+
+// unwrapFast decodes a PA-FX-FAST element from a KDC reply's padata,
+// verifies the reply checksum under armorKey, and derives the
+// strengthened reply key the real reply key should be swapped out for
+// (RFC 6113 5.4.3).
+func unwrapFast(padata []preauth, armorKey fastCipher, replyKey fastCipher, bodyData []byte, nonce uint32) (cipher, error) {
+	var fastData []byte
+	for _, p := range padata {
+		if p.Type == paFxFast {
+			fastData = p.Value
+			break
+		}
+	}
+	if fastData == nil {
+		return nil, fmt.Errorf("kerb: KDC reply is missing PA-FX-FAST")
+	}
+
+	var armoredRep krbFastArmoredRep
+	if _, err := asn1.Unmarshal(fastData, &armoredRep); err != nil {
+		return nil, err
+	}
+
+	want := armorKey.checksum(bodyData, fastRepChecksumKey)
+	if !hmac.Equal(want, armoredRep.ReqChecksum) {
+		return nil, fmt.Errorf("kerb: PA-FX-FAST reply checksum mismatch")
+	}
+
+	plain, err := armorKey.decrypt(armoredRep.EncFastRep, fastRepKey)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp krbFastResponse
+	if _, err := asn1.Unmarshal(plain, &resp); err != nil {
+		return nil, err
+	}
+	if resp.Nonce != nonce {
+		return nil, ErrProtocol
+	}
+
+	// If the KDC sent a strengthen-key, the actual reply key is derived
+	// from it rather than from the armor key (RFC 6113 5.4.3): the whole
+	// point of StrengthenKey is to bind the session key to randomness
+	// the client alone couldn't have predicted, which the armor key
+	// (already known to both sides from the armor ticket) doesn't give.
+	combineWith := armorKey
+	if len(resp.StrengthenKey.Key) > 0 {
+		strengthenKey, err := loadKey(resp.StrengthenKey.Algorithm, resp.StrengthenKey.Key, 0)
+		if err != nil {
+			return nil, err
+		}
+		fc, ok := strengthenKey.(fastCipher)
+		if !ok {
+			return nil, fmt.Errorf("kerb: KDC strengthen key's enctype does not support FAST")
+		}
+		combineWith = fc
+	}
+
+	return krbFXCF2(replyKey, combineWith, cf2Pepper1, cf2Pepper2)
+}
+
+// freshSubkey generates a random session key of the same enctype as
+// like, for use as the armor AP-REQ's authenticator subkey. It returns
+// both the usable cipher and its encryptionKey encoding, since the
+// caller must place the latter in the authenticator it marshals for the
+// KDC -- krbFXCF2 only derives the armor key on our side, it doesn't
+// hand the KDC any way to reconstruct it on its own.
+func freshSubkey(like fastCipher) (fastCipher, encryptionKey, error) {
+	n := like.keyGenLength()
+	raw := make([]byte, n)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, encryptionKey{}, err
+	}
+
+	etype, _ := like.etype()
+	key, err := loadKey(etype, raw, 0)
+	if err != nil {
+		return nil, encryptionKey{}, err
+	}
+
+	fc, ok := key.(fastCipher)
+	if !ok {
+		return nil, encryptionKey{}, fmt.Errorf("kerb: freshly generated subkey does not support FAST")
+	}
+	return fc, encryptionKey{Algorithm: etype, Key: raw}, nil
+}
